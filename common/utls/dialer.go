@@ -0,0 +1,84 @@
+package utls
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc establishes the underlying connection a uTLS handshake will run
+// over. Supplying one via WithDialer lets the fingerprinted TLS layer be
+// chained over SOCKS5, HTTP CONNECT, another pluggable transport, or (in
+// tests) a net.Pipe, instead of always opening a raw TCP socket itself.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithDialer overrides the func used to establish the connection the TLS
+// handshake runs over. If no Option supplies one, the default is an
+// ordinary net.Dialer dialing addr directly over network.
+func WithDialer(dial DialFunc) Option {
+	return func(rt *uTLSHTTPRoundTripperImpl) {
+		rt.dial = dial
+	}
+}
+
+// NewSOCKS5Dialer returns a DialFunc that reaches its addr through a SOCKS5
+// proxy listening at proxyAddr, authenticating with user/password if
+// either is non-empty.
+func NewSOCKS5Dialer(proxyAddr, user, password string) (DialFunc, error) {
+	var auth *proxy.Auth
+	if user != "" || password != "" {
+		auth = &proxy.Auth{User: user, Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("utls roundtripper: building SOCKS5 dialer: %w", err)
+	}
+	contextDialer, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.Dial(network, addr)
+		}, nil
+	}
+	return contextDialer.DialContext, nil
+}
+
+// NewHTTPConnectDialer returns a DialFunc that reaches its addr by dialing
+// proxyAddr and issuing an HTTP CONNECT request, the same technique a
+// browser uses to tunnel HTTPS through a corporate proxy.
+func NewHTTPConnectDialer(proxyAddr string) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, fmt.Errorf("utls roundtripper: dialing CONNECT proxy %s: %w", proxyAddr, err)
+		}
+
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("utls roundtripper: writing CONNECT request: %w", err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("utls roundtripper: reading CONNECT response: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("utls roundtripper: CONNECT to %s via %s: %s", addr, proxyAddr, resp.Status)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,150 @@
+package utls
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// FingerprintPolicy selects the utls.ClientHelloID presented for a given
+// connection attempt. A single pinned fingerprint is trivially
+// identifiable and hard to keep current against evolving browsers, so the
+// roundtripper asks a policy for an ID instead of taking one directly.
+type FingerprintPolicy interface {
+	// NextHello returns the ClientHelloID to use for a new TLS connection
+	// to host (already stripped of port). Implementations that rotate
+	// fingerprints may return a different ID on every call, even for the
+	// same host.
+	NextHello(host string) utls.ClientHelloID
+}
+
+// randSource is an optional capability a FingerprintPolicy can implement
+// to supply a deterministic source of randomness for that connection's
+// ClientHello generation. It matters for utls's HelloRandomized and
+// HelloRandomizedALPN IDs, whose extension order and values are otherwise
+// drawn from an unseeded source.
+type randSource interface {
+	RandSource() io.Reader
+}
+
+// StaticFingerprintPolicy always returns the same ClientHelloID. It is the
+// policy equivalent of the roundtripper's original behavior of taking a
+// single fixed ID.
+type StaticFingerprintPolicy struct {
+	ID utls.ClientHelloID
+}
+
+// NewStaticFingerprintPolicy returns a FingerprintPolicy that always
+// presents id.
+func NewStaticFingerprintPolicy(id utls.ClientHelloID) StaticFingerprintPolicy {
+	return StaticFingerprintPolicy{ID: id}
+}
+
+func (p StaticFingerprintPolicy) NextHello(string) utls.ClientHelloID {
+	return p.ID
+}
+
+// WeightedHello pairs a ClientHelloID with its relative selection weight
+// in a WeightedFingerprintPolicy's pool. Weights don't need to sum to any
+// particular total; they're normalized at selection time.
+type WeightedHello struct {
+	ID     utls.ClientHelloID
+	Weight float64
+}
+
+// WeightedFingerprintPolicy samples a ClientHelloID from Pool on every
+// call, in proportion to each entry's Weight, so that a population of
+// connections blends in with real-world browser market share instead of
+// presenting one single, identifiable fingerprint.
+type WeightedFingerprintPolicy struct {
+	Pool []WeightedHello
+}
+
+// NewWeightedFingerprintPolicy returns a FingerprintPolicy that samples
+// from pool using the default global randomness source.
+func NewWeightedFingerprintPolicy(pool []WeightedHello) *WeightedFingerprintPolicy {
+	return &WeightedFingerprintPolicy{Pool: pool}
+}
+
+func (p *WeightedFingerprintPolicy) NextHello(string) utls.ClientHelloID {
+	var total float64
+	for _, w := range p.Pool {
+		total += w.Weight
+	}
+	if total <= 0 || len(p.Pool) == 0 {
+		return utls.HelloGolang
+	}
+
+	// rand's top-level functions draw from the default global source,
+	// which is safe for concurrent use and (since Go 1.20) auto-seeded
+	// from real entropy, so every process draws a different sequence.
+	r := rand.Float64() * total
+
+	for _, w := range p.Pool {
+		if r < w.Weight {
+			return w.ID
+		}
+		r -= w.Weight
+	}
+	return p.Pool[len(p.Pool)-1].ID
+}
+
+// RandomizedFingerprintPolicy always selects one of utls's own
+// HelloRandomized IDs, which generate a fresh, plausible-looking
+// ClientHello (extension order, included extensions, etc.) per
+// connection rather than replaying a fixed template. Seeding it makes
+// that generation reproducible, which is useful for tests and for
+// diagnosing a specific capture.
+type RandomizedFingerprintPolicy struct {
+	IncludeALPN bool
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewRandomizedFingerprintPolicy returns a FingerprintPolicy that presents
+// HelloRandomized (or HelloRandomizedALPN, if includeALPN is set), with
+// its internal randomness seeded from seed so repeated runs produce the
+// same sequence of generated ClientHellos.
+func NewRandomizedFingerprintPolicy(seed int64, includeALPN bool) *RandomizedFingerprintPolicy {
+	return &RandomizedFingerprintPolicy{
+		IncludeALPN: includeALPN,
+		rng:         rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (p *RandomizedFingerprintPolicy) NextHello(string) utls.ClientHelloID {
+	if p.IncludeALPN {
+		return utls.HelloRandomizedALPN
+	}
+	return utls.HelloRandomized
+}
+
+// RandSource implements randSource, giving the roundtripper a
+// deterministic byte stream (derived from this policy's seed) to use as
+// the TLS config's Rand field for the connection this ID was selected
+// for.
+func (p *RandomizedFingerprintPolicy) RandSource() io.Reader {
+	return (*seededReader)(p)
+}
+
+type seededReader RandomizedFingerprintPolicy
+
+func (r *seededReader) Read(b []byte) (int, error) {
+	p := (*RandomizedFingerprintPolicy)(r)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range b {
+		b[i] = byte(p.rng.Intn(256))
+	}
+	return len(b), nil
+}
+
+// helloCacheKey returns a stable string identifying a ClientHelloID for
+// use as (part of) a connection cache key, so that two different
+// effective IDs for the same host never collide on one cached connection.
+func helloCacheKey(id utls.ClientHelloID) string {
+	return id.Client + "/" + id.Version
+}
@@ -0,0 +1,159 @@
+package utls
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	uquic "github.com/refraction-networking/uquic"
+	uquich3 "github.com/refraction-networking/uquic/http3"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// attempt carries the outcome of one leg of the H2/H3 race.
+type attempt struct {
+	transport http.RoundTripper
+	err       error
+}
+
+// WithHTTP3 enables racing an HTTP/3-over-QUIC dial against the existing
+// H1/H2-over-TCP dial for hosts this roundtripper has no cached connection
+// to yet, in a happy-eyeballs style: whichever handshake completes first
+// wins, the other is abandoned. Once a connection is cached for a given
+// (host:port, ClientHelloID) pair, subsequent requests reuse it directly
+// and no further racing happens for that pair -- so the negotiated
+// protocol is effectively "remembered" by the ordinary connection cache
+// without needing a separate table.
+func WithHTTP3(enabled bool) Option {
+	return func(rt *uTLSHTTPRoundTripperImpl) {
+		rt.http3Enabled = enabled
+	}
+}
+
+// h3RoundTripper adapts a uquic HTTP/3 client transport bound to one
+// already-established QUIC connection to http.RoundTripper, so it fits the
+// same connection-cache shape as the TCP-based h1RoundTripper and
+// http2.ClientConn.
+type h3RoundTripper struct {
+	quicConn uquic.EarlyConnection
+	rt       *uquich3.Transport
+}
+
+func (h *h3RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return h.rt.RoundTripOpt(req, uquich3.RoundTripOpt{})
+}
+
+// dialH3 opens a QUIC connection to addr with a uTLS-flavored ClientHello
+// matching id and wraps it in an HTTP/3 transport.
+func (rt *uTLSHTTPRoundTripperImpl) dialH3(ctx context.Context, addr, host string, id utls.ClientHelloID) (http.RoundTripper, error) {
+	cfg := rt.utlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	cfg.NextProtos = []string{"h3"}
+	if rs, ok := rt.policy.(randSource); ok {
+		cfg.Rand = rs.RandSource()
+	}
+
+	handshakeStart := time.Now()
+	qconn, err := uquic.DialAddrEarly(ctx, addr, cfg, &uquic.Config{}, id)
+	if err != nil {
+		return nil, fmt.Errorf("quic dial %s as %s: %w", addr, id.Client, err)
+	}
+	rt.observer.OnHandshake(id, "h3", time.Since(handshakeStart))
+
+	return &h3RoundTripper{quicConn: qconn, rt: &uquich3.Transport{}}, nil
+}
+
+// raceH2H3 dials the H2-over-TCP and H3-over-UDP paths concurrently and
+// returns whichever completes its handshake first, cancelling the other.
+// If http3Enabled is false this degenerates to the plain TCP dial.
+func (rt *uTLSHTTPRoundTripperImpl) raceH2H3(ctx context.Context, addr, host string, id utls.ClientHelloID) (http.RoundTripper, error) {
+	if !rt.http3Enabled {
+		return rt.dialTCP(ctx, addr, host, id)
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan attempt, 2)
+
+	go func() {
+		t, err := rt.dialTCP(raceCtx, addr, host, id)
+		results <- attempt{t, err}
+	}()
+	go func() {
+		t, err := rt.dialH3(raceCtx, addr, host, id)
+		results <- attempt{t, err}
+	}()
+
+	var lastErr error
+	for i := 0; i < 2; i++ {
+		a := <-results
+		if a.err == nil {
+			cancel()
+			// The other dial may already be in flight or may itself
+			// succeed after we've stopped looking; either way it's not
+			// going to be used, so drain its result off the channel and
+			// close whatever live transport it produced instead of
+			// leaking the connection and its goroutines.
+			go closeLoser(results, 1-i)
+			return a.transport, nil
+		}
+		lastErr = a.err
+	}
+	return nil, lastErr
+}
+
+// closeLoser reads the remaining `n` results off results (the race's
+// abandoned dial(s)) and closes any transport they produced.
+func closeLoser(results <-chan attempt, n int) {
+	for i := 0; i < n; i++ {
+		a := <-results
+		if a.err == nil {
+			closeTransport(a.transport)
+		}
+	}
+}
+
+// closeTransport closes the underlying connection of a RoundTripper
+// produced by dialTCP or dialH3, whichever concrete type it is.
+func closeTransport(t http.RoundTripper) {
+	switch rt := t.(type) {
+	case *http2.ClientConn:
+		rt.Close()
+	case *h1RoundTripper:
+		rt.conn.Close()
+	case *h3RoundTripper:
+		rt.quicConn.CloseWithError(0, "")
+	}
+}
+
+// recordAltSvc inspects resp for an Alt-Svc header advertising h3 support
+// and, if found, remembers it against addr, where altSvcH3Seen(addr) reports
+// it. Nothing in the dial path consults it: the race happens
+// unconditionally for every cold (addr, id) pair when HTTP/3 is enabled.
+func (rt *uTLSHTTPRoundTripperImpl) recordAltSvc(addr string, resp *http.Response) {
+	altSvc := resp.Header.Get("Alt-Svc")
+	if altSvc == "" {
+		return
+	}
+	if !strings.Contains(altSvc, "h3=") {
+		return
+	}
+	rt.cacheMutex.Lock()
+	defer rt.cacheMutex.Unlock()
+	if rt.altSvcH3 == nil {
+		rt.altSvcH3 = make(map[string]bool)
+	}
+	rt.altSvcH3[addr] = true
+}
+
+func (rt *uTLSHTTPRoundTripperImpl) altSvcH3Seen(addr string) bool {
+	rt.cacheMutex.Lock()
+	defer rt.cacheMutex.Unlock()
+	return rt.altSvcH3[addr]
+}
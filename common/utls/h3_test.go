@@ -0,0 +1,63 @@
+package utls
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	utls "github.com/refraction-networking/utls"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRoundTripperHTTP3(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Testing Certificate"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 180),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http3.Server{
+		Addr: "127.0.0.1:23803",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	rtter := NewUTLSHTTPRoundTripper(
+		NewStaticFingerprintPolicy(utls.HelloChrome_58),
+		&utls.Config{InsecureSkipVerify: true},
+		http.DefaultTransport,
+		WithHTTP3(true),
+	)
+
+	Convey("HTTP/3 request races and succeeds", t, func(c C) {
+		req, err := http.NewRequest("GET", "https://127.0.0.1:23803/", nil)
+		So(err, ShouldBeNil)
+		_, err = rtter.RoundTrip(req)
+		So(err, ShouldBeNil)
+	})
+}
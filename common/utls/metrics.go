@@ -0,0 +1,71 @@
+package utls
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	utls "github.com/refraction-networking/utls"
+)
+
+// PrometheusObserver is an Observer that records dial, handshake, retry,
+// protocol-fallback, and connection-reuse events as Prometheus metrics, for
+// embedders who already expose a /metrics endpoint and want the
+// roundtripper's behavior folded into it rather than logged separately.
+type PrometheusObserver struct {
+	dials            *prometheus.CounterVec
+	handshakeSeconds *prometheus.HistogramVec
+	retries          *prometheus.CounterVec
+	fallbacks        *prometheus.CounterVec
+	reuses           *prometheus.CounterVec
+}
+
+// NewPrometheusObserver constructs a PrometheusObserver and registers its
+// metrics with reg. Metric names are prefixed utls_roundtripper_.
+func NewPrometheusObserver(reg prometheus.Registerer) *PrometheusObserver {
+	p := &PrometheusObserver{
+		dials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "utls_roundtripper_dials_total",
+			Help: "Number of fresh connection dials attempted, by target address.",
+		}, []string{"addr"}),
+		handshakeSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "utls_roundtripper_handshake_seconds",
+			Help:    "TLS/QUIC handshake duration, by ClientHello fingerprint and negotiated ALPN protocol.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"hello", "alpn"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "utls_roundtripper_retries_total",
+			Help: "Number of failed connection attempts that were retried, by 0-based attempt number.",
+		}, []string{"attempt"}),
+		fallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "utls_roundtripper_protocol_fallbacks_total",
+			Help: "Number of times the negotiated protocol for an address changed between attempts.",
+		}, []string{"addr", "from", "to"}),
+		reuses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "utls_roundtripper_connection_reuses_total",
+			Help: "Number of requests served from a cached connection, by negotiated protocol.",
+		}, []string{"protocol"}),
+	}
+	reg.MustRegister(p.dials, p.handshakeSeconds, p.retries, p.fallbacks, p.reuses)
+	return p
+}
+
+func (p *PrometheusObserver) OnDial(addr string) {
+	p.dials.WithLabelValues(addr).Inc()
+}
+
+func (p *PrometheusObserver) OnHandshake(hello utls.ClientHelloID, alpn string, duration time.Duration) {
+	p.handshakeSeconds.WithLabelValues(hello.Client, alpn).Observe(duration.Seconds())
+}
+
+func (p *PrometheusObserver) OnProtocolFallback(addr, from, to string) {
+	p.fallbacks.WithLabelValues(addr, from, to).Inc()
+}
+
+func (p *PrometheusObserver) OnRetry(attempt int, err error) {
+	p.retries.WithLabelValues(strconv.Itoa(attempt)).Inc()
+}
+
+func (p *PrometheusObserver) OnConnectionReuse(addr, protocol string) {
+	p.reuses.WithLabelValues(protocol).Inc()
+}
@@ -0,0 +1,64 @@
+package utls
+
+import (
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// Observer receives structured events from a uTLSHTTPRoundTripperImpl as it
+// dials, handshakes, and serves requests. It turns what would otherwise be
+// a black box on failure into something an operator can act on: why a
+// bridge keeps falling back to H1, how handshake latency varies by
+// fingerprint, or that a particular fingerprint has started being blocked.
+type Observer interface {
+	// OnDial is called immediately before dialing addr for a fresh
+	// connection; it is not called for a cache hit.
+	OnDial(addr string)
+	// OnHandshake is called after a TLS (or QUIC) handshake with hello
+	// completes successfully, reporting the negotiated ALPN protocol and
+	// how long the handshake took.
+	OnHandshake(hello utls.ClientHelloID, alpn string, duration time.Duration)
+	// OnProtocolFallback is called when the protocol negotiated for addr
+	// differs from the one last negotiated for it, e.g. "h3" -> "h2"
+	// because an HTTP/3 dial stopped succeeding.
+	OnProtocolFallback(addr, from, to string)
+	// OnRetry is called after a connection attempt fails, with the
+	// 0-based attempt number that just failed and its error, before the
+	// roundtripper tries again.
+	OnRetry(attempt int, err error)
+	// OnConnectionReuse is called when a cached connection is reused
+	// instead of dialing fresh.
+	OnConnectionReuse(addr, protocol string)
+}
+
+// WithObserver registers an Observer to receive this roundtripper's dial,
+// handshake, retry, and cache-reuse events.
+func WithObserver(observer Observer) Option {
+	return func(rt *uTLSHTTPRoundTripperImpl) {
+		rt.observer = observer
+	}
+}
+
+// noopObserver is installed by default so call sites never need a nil
+// check before invoking an Observer method.
+type noopObserver struct{}
+
+func (noopObserver) OnDial(addr string)                                                 {}
+func (noopObserver) OnHandshake(hello utls.ClientHelloID, alpn string, d time.Duration) {}
+func (noopObserver) OnProtocolFallback(addr, from, to string)                           {}
+func (noopObserver) OnRetry(attempt int, err error)                                     {}
+func (noopObserver) OnConnectionReuse(addr, protocol string)                            {}
+
+// protocolName identifies the ALPN-level protocol a cached transport
+// negotiated, for OnConnectionReuse and OnProtocolFallback reporting.
+func protocolName(t interface{}) string {
+	switch t.(type) {
+	case *h1RoundTripper:
+		return "http/1.1"
+	case *h3RoundTripper:
+		return "h3"
+	default:
+		return "h2"
+	}
+}
@@ -0,0 +1,307 @@
+// Package utls provides an http.RoundTripper that performs the TLS
+// handshake with a caller-chosen fingerprint (via refraction-networking's
+// utls) instead of Go's own, so that HTTPS traffic to the broker or a
+// domain-fronted rendezvous doesn't stick out as a non-browser TLS stack.
+package utls
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// Option configures a uTLSHTTPRoundTripperImpl at construction time.
+type Option func(*uTLSHTTPRoundTripperImpl)
+
+// WithHelloObserver registers a callback invoked every time a connection
+// selects a ClientHelloID, letting the caller log or record metrics on
+// which fingerprint was actually used for a given host.
+func WithHelloObserver(fn func(host string, id utls.ClientHelloID)) Option {
+	return func(rt *uTLSHTTPRoundTripperImpl) {
+		rt.helloObserver = fn
+	}
+}
+
+// uTLSHTTPRoundTripperImpl is an http.RoundTripper that dials and
+// handshakes TLS itself using utls, presenting the ClientHelloID its
+// FingerprintPolicy selects, then negotiates HTTP/1.1 or HTTP/2 over ALPN.
+// Successful connections are cached per (host:port, effective ID) so
+// repeat requests reuse the negotiated connection instead of
+// re-handshaking every time, without pinning a rotating policy to its
+// first-chosen fingerprint forever.
+type uTLSHTTPRoundTripperImpl struct {
+	policy     FingerprintPolicy
+	utlsConfig *utls.Config
+	fallback   http.RoundTripper
+
+	helloObserver func(host string, id utls.ClientHelloID)
+	http3Enabled  bool
+	sniPolicy     SNIPolicy
+	dial          DialFunc
+	observer      Observer
+
+	cacheMutex   sync.Mutex
+	cached       map[string]http.RoundTripper
+	altSvcH3     map[string]bool
+	lastProtocol map[string]string
+
+	pendingMutex sync.Mutex
+	pending      map[string]*pendingConn
+}
+
+type pendingConn struct {
+	done      chan struct{}
+	transport http.RoundTripper
+	err       error
+}
+
+// NewUTLSHTTPRoundTripper returns an http.RoundTripper that handshakes TLS
+// with the ClientHelloID(s) policy selects. utlsConfig is cloned per
+// connection (its ServerName is filled in from the request host if
+// empty). fallback, if non-nil, handles requests this roundtripper can't
+// itself (currently: plain "http" scheme requests).
+func NewUTLSHTTPRoundTripper(policy FingerprintPolicy, utlsConfig *utls.Config, fallback http.RoundTripper, opts ...Option) http.RoundTripper {
+	rt := &uTLSHTTPRoundTripperImpl{
+		policy:       policy,
+		utlsConfig:   utlsConfig,
+		fallback:     fallback,
+		dial:         (&net.Dialer{}).DialContext,
+		observer:     noopObserver{},
+		cached:       make(map[string]http.RoundTripper),
+		pending:      make(map[string]*pendingConn),
+		lastProtocol: make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	return rt
+}
+
+func (rt *uTLSHTTPRoundTripperImpl) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		if rt.fallback == nil {
+			return nil, fmt.Errorf("utls roundtripper: unsupported scheme %q", req.URL.Scheme)
+		}
+		return rt.fallback.RoundTrip(req)
+	}
+
+	host := req.URL.Hostname()
+	id := rt.policy.NextHello(host)
+	if rt.helloObserver != nil {
+		rt.helloObserver(host, id)
+	}
+
+	// addr is the request's URL host:port (default port filled in), the
+	// same target later passed to rt.dial, so distinct logical hosts that
+	// happen to share a proxy or front never collide in the cache or
+	// pending map below.
+	addr := canonicalAddr(req.URL)
+	cacheKey := addr + "#" + helloCacheKey(id) + "#" + rt.sniPolicy.cacheSuffix()
+
+	if cached := rt.getCached(cacheKey); cached != nil {
+		rt.observer.OnConnectionReuse(addr, protocolName(cached))
+		resp, err := cached.RoundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+		// The cached connection died (peer GOAWAY, reset, idle close);
+		// evict it so the next request dials fresh instead of every
+		// request to this host failing forever.
+		rt.evictCached(cacheKey, cached)
+		// The failed attempt may have already drained req.Body; get a
+		// fresh copy before reusing req below, same as net/http's own
+		// Transport does across a retried request.
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return nil, err
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		transport, err := rt.connectWithH1(req.Context(), addr, host, id)
+		if err != nil {
+			lastErr = err
+			if attempt+1 < 5 {
+				rt.observer.OnRetry(attempt, err)
+			}
+			continue
+		}
+		rt.setCached(cacheKey, transport)
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			rt.recordAltSvc(addr, resp)
+		}
+		return resp, err
+	}
+	return nil, fmt.Errorf("utls roundtripper: giving up on %s after 5 attempts: %w", addr, lastErr)
+}
+
+func (rt *uTLSHTTPRoundTripperImpl) getCached(key string) http.RoundTripper {
+	rt.cacheMutex.Lock()
+	defer rt.cacheMutex.Unlock()
+	return rt.cached[key]
+}
+
+func (rt *uTLSHTTPRoundTripperImpl) setCached(key string, transport http.RoundTripper) {
+	rt.cacheMutex.Lock()
+	defer rt.cacheMutex.Unlock()
+	rt.cached[key] = transport
+}
+
+// evictCached removes key from the cache, but only if it still holds
+// stale -- a fresh connection may have already replaced it by the time a
+// caller notices stale is dead -- and closes the discarded transport.
+func (rt *uTLSHTTPRoundTripperImpl) evictCached(key string, stale http.RoundTripper) {
+	rt.cacheMutex.Lock()
+	if rt.cached[key] == stale {
+		delete(rt.cached, key)
+	}
+	rt.cacheMutex.Unlock()
+	closeTransport(stale)
+}
+
+// connectWithH1 dials and TLS-handshakes a fresh connection to addr using
+// ClientHelloID id, deduplicating concurrent callers for the same
+// (addr, id) pair so a burst of requests to a host we haven't connected to
+// yet doesn't open one raw TCP connection per request. Despite the name
+// (kept for continuity with the original single-protocol dial path), the
+// returned transport may negotiate either HTTP/1.1 or HTTP/2 depending on
+// ALPN, or be HTTP/3 when WithHTTP3 is enabled and the QUIC dial wins the
+// race.
+func (rt *uTLSHTTPRoundTripperImpl) connectWithH1(ctx context.Context, addr, host string, id utls.ClientHelloID) (http.RoundTripper, error) {
+	key := addr + "#" + helloCacheKey(id) + "#" + rt.sniPolicy.cacheSuffix()
+
+	rt.pendingMutex.Lock()
+	if p, ok := rt.pending[key]; ok {
+		rt.pendingMutex.Unlock()
+		<-p.done
+		return p.transport, p.err
+	}
+	p := &pendingConn{done: make(chan struct{})}
+	rt.pending[key] = p
+	rt.pendingMutex.Unlock()
+
+	rt.observer.OnDial(addr)
+	p.transport, p.err = rt.raceH2H3(ctx, addr, host, id)
+	if p.err == nil {
+		rt.recordProtocol(addr, protocolName(p.transport))
+	}
+	close(p.done)
+
+	rt.pendingMutex.Lock()
+	delete(rt.pending, key)
+	rt.pendingMutex.Unlock()
+
+	return p.transport, p.err
+}
+
+// recordProtocol remembers the protocol negotiated for addr and notifies
+// the observer when it differs from what was negotiated last time, e.g.
+// an HTTP/3 dial that used to win the race starting to lose it.
+func (rt *uTLSHTTPRoundTripperImpl) recordProtocol(addr, protocol string) {
+	rt.cacheMutex.Lock()
+	defer rt.cacheMutex.Unlock()
+	if prev, ok := rt.lastProtocol[addr]; ok && prev != protocol {
+		rt.observer.OnProtocolFallback(addr, prev, protocol)
+	}
+	rt.lastProtocol[addr] = protocol
+}
+
+// dialTCP establishes the stream connection via rt.dial (a raw TCP socket
+// by default, or a SOCKS5/CONNECT/net.Pipe dialer if the caller supplied
+// one with WithDialer) and TLS-handshakes over it, then negotiates H1/H2
+// over ALPN. It is also the h2 half of the H2-vs-H3 race in raceH2H3.
+func (rt *uTLSHTTPRoundTripperImpl) dialTCP(ctx context.Context, addr, host string, id utls.ClientHelloID) (http.RoundTripper, error) {
+	rawConn, err := rt.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	var conn net.Conn = rawConn
+	if rt.sniPolicy.Mode == SNISplit {
+		conn = &splitWriteConn{Conn: rawConn}
+	}
+
+	cfg := rt.utlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if rs, ok := rt.policy.(randSource); ok {
+		cfg.Rand = rs.RandSource()
+	}
+
+	switch rt.sniPolicy.Mode {
+	case SNICover:
+		realHost := cfg.ServerName
+		roots := cfg.RootCAs
+		insecure := cfg.InsecureSkipVerify
+		cfg.ServerName = rt.sniPolicy.CoverSNI
+		if !insecure {
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyAgainstHost(rawCerts, roots, realHost)
+			}
+		}
+	case SNIECH:
+		cfg.EncryptedClientHelloConfigList = rt.sniPolicy.ECHConfigList
+	}
+
+	uconn := utls.UClient(conn, cfg, id)
+	handshakeStart := time.Now()
+	if err := uconn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s as %s: %w", addr, id.Client, err)
+	}
+	rt.observer.OnHandshake(id, uconn.ConnectionState().NegotiatedProtocol, time.Since(handshakeStart))
+
+	switch uconn.ConnectionState().NegotiatedProtocol {
+	case http2.NextProtoTLS:
+		t2 := &http2.Transport{}
+		cc, err := t2.NewClientConn(uconn)
+		if err != nil {
+			uconn.Close()
+			return nil, err
+		}
+		return cc, nil
+	default:
+		return &h1RoundTripper{conn: uconn, client: httputil.NewClientConn(uconn, nil)}, nil
+	}
+}
+
+// h1RoundTripper adapts the deprecated but still functional
+// httputil.ClientConn to http.RoundTripper, so HTTP/1.1 connections fit
+// the same cache shape as the http2.ClientConn case.
+type h1RoundTripper struct {
+	conn   net.Conn
+	client *httputil.ClientConn
+}
+
+func (h *h1RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return h.client.Do(req)
+}
+
+// canonicalAddr returns the host:port a request's URL should be dialed
+// at, filling in the default HTTPS port when the URL doesn't specify one.
+func canonicalAddr(u *url.URL) string {
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port)
+}
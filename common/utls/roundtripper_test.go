@@ -6,9 +6,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	utls "github.com/refraction-networking/utls"
 	"golang.org/x/net/http2"
 	"math/big"
+	"net"
 	"net/http"
 	"testing"
 	"time"
@@ -18,6 +20,8 @@ import . "github.com/smartystreets/goconvey/convey"
 
 import stdcontext "context"
 
+var errListenerClosed = errors.New("singleConnListener: closed")
+
 func TestRoundTripper(t *testing.T) {
 	var selfSignedCert []byte
 	var selfSignedPrivateKey *rsa.PrivateKey
@@ -125,7 +129,7 @@ func TestRoundTripper(t *testing.T) {
 		},
 	} {
 		t.Run("Testing fingerprint for "+v.name, func(t *testing.T) {
-			rtter := NewUTLSHTTPRoundTripper(v.id, &utls.Config{
+			rtter := NewUTLSHTTPRoundTripper(NewStaticFingerprintPolicy(v.id), &utls.Config{
 				InsecureSkipVerify: true,
 			}, http.DefaultTransport)
 
@@ -151,5 +155,211 @@ func TestRoundTripper(t *testing.T) {
 		})
 	}
 
+	t.Run("Testing weighted fingerprint rotation", func(t *testing.T) {
+		var seen []string
+		policy := NewWeightedFingerprintPolicy([]WeightedHello{
+			{ID: utls.HelloChrome_58, Weight: 1},
+			{ID: utls.HelloFirefox_55, Weight: 1},
+		})
+		rtter := NewUTLSHTTPRoundTripper(policy, &utls.Config{
+			InsecureSkipVerify: true,
+		}, http.DefaultTransport, WithHelloObserver(func(host string, id utls.ClientHelloID) {
+			seen = append(seen, id.Client)
+		}))
+
+		for count := 0; count < 5; count++ {
+			Convey("HTTP 1.1 Test with rotating fingerprint", t, func(c C) {
+				req, err := http.NewRequest("GET", "https://127.0.0.1:23801/", nil)
+				So(err, ShouldBeNil)
+				_, err = rtter.RoundTrip(req)
+				So(err, ShouldBeNil)
+			})
+		}
+		Convey("the observer saw one hello per request", t, func(c C) {
+			So(len(seen), ShouldEqual, 5)
+		})
+	})
+
+	t.Run("Testing SNI concealment modes", func(t *testing.T) {
+		for _, mode := range []struct {
+			name   string
+			policy SNIPolicy
+		}{
+			{"split", SNIPolicy{Mode: SNISplit}},
+			{"cover", SNIPolicy{Mode: SNICover, CoverSNI: "cdn.example.com"}},
+			{"ech with no config list is a no-op", SNIPolicy{Mode: SNIECH}},
+		} {
+			rtter := NewUTLSHTTPRoundTripper(
+				NewStaticFingerprintPolicy(utls.HelloChrome_58),
+				&utls.Config{InsecureSkipVerify: true},
+				http.DefaultTransport,
+				WithSNIPolicy(mode.policy),
+			)
+			Convey("SNI mode "+mode.name+" still completes the handshake", t, func(c C) {
+				req, err := http.NewRequest("GET", "https://127.0.0.1:23801/", nil)
+				So(err, ShouldBeNil)
+				_, err = rtter.RoundTrip(req)
+				So(err, ShouldBeNil)
+			})
+		}
+	})
+
+	t.Run("Testing pluggable dialer with a net.Pipe loopback", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+
+		tlsServerConn := tls.Server(serverConn, &tls.Config{
+			NextProtos: []string{"http/1.1"},
+			Certificates: []tls.Certificate{
+				tls.Certificate{Certificate: [][]byte{selfSignedCert}, PrivateKey: selfSignedPrivateKey},
+			},
+		})
+		go http.Serve(newSingleConnListener(tlsServerConn), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		var dialed bool
+		rtter := NewUTLSHTTPRoundTripper(
+			NewStaticFingerprintPolicy(utls.HelloChrome_58),
+			&utls.Config{InsecureSkipVerify: true},
+			http.DefaultTransport,
+			WithDialer(func(ctx stdcontext.Context, network, addr string) (net.Conn, error) {
+				dialed = true
+				return clientConn, nil
+			}),
+		)
+
+		Convey("the pipe-backed dial completes the handshake with no real socket", t, func(c C) {
+			req, err := http.NewRequest("GET", "https://pipe.invalid/", nil)
+			So(err, ShouldBeNil)
+			_, err = rtter.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(dialed, ShouldBeTrue)
+		})
+	})
+
+	t.Run("Testing observer hooks fire for dial, handshake, and reuse", func(t *testing.T) {
+		var dials, reuses int
+		var sawHandshake bool
+		rtter := NewUTLSHTTPRoundTripper(
+			NewStaticFingerprintPolicy(utls.HelloChrome_58),
+			&utls.Config{InsecureSkipVerify: true},
+			http.DefaultTransport,
+			WithObserver(observerFuncs{
+				onDial: func(addr string) { dials++ },
+				onHandshake: func(hello utls.ClientHelloID, alpn string, d time.Duration) {
+					sawHandshake = true
+				},
+				onConnectionReuse: func(addr, protocol string) { reuses++ },
+			}),
+		)
+
+		Convey("first request dials and handshakes", t, func(c C) {
+			req, err := http.NewRequest("GET", "https://127.0.0.1:23801/", nil)
+			So(err, ShouldBeNil)
+			_, err = rtter.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(dials, ShouldEqual, 1)
+			So(sawHandshake, ShouldBeTrue)
+		})
+
+		Convey("second request reuses the cached connection", t, func(c C) {
+			req, err := http.NewRequest("GET", "https://127.0.0.1:23801/", nil)
+			So(err, ShouldBeNil)
+			_, err = rtter.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(dials, ShouldEqual, 1)
+			So(reuses, ShouldEqual, 1)
+		})
+	})
+
+	t.Run("Testing seeded randomized fingerprint is reproducible", func(t *testing.T) {
+		var a, b utls.ClientHelloID
+		policyA := NewRandomizedFingerprintPolicy(42, false)
+		policyB := NewRandomizedFingerprintPolicy(42, false)
+		a = policyA.NextHello("127.0.0.1")
+		b = policyB.NextHello("127.0.0.1")
+		Convey("two policies with the same seed agree on the ID family", t, func(c C) {
+			So(a.Client, ShouldEqual, b.Client)
+		})
+		Convey("two policies with the same seed produce the same random stream", t, func(c C) {
+			bufA := make([]byte, 32)
+			bufB := make([]byte, 32)
+			policyA.RandSource().Read(bufA)
+			policyB.RandSource().Read(bufB)
+			So(bufA, ShouldResemble, bufB)
+		})
+	})
+
 	cancel()
-}
\ No newline at end of file
+}
+
+// observerFuncs adapts zero or more plain funcs to the Observer interface,
+// for tests that only care about one or two of its methods.
+type observerFuncs struct {
+	onDial             func(addr string)
+	onHandshake        func(hello utls.ClientHelloID, alpn string, duration time.Duration)
+	onProtocolFallback func(addr, from, to string)
+	onRetry            func(attempt int, err error)
+	onConnectionReuse  func(addr, protocol string)
+}
+
+func (o observerFuncs) OnDial(addr string) {
+	if o.onDial != nil {
+		o.onDial(addr)
+	}
+}
+
+func (o observerFuncs) OnHandshake(hello utls.ClientHelloID, alpn string, duration time.Duration) {
+	if o.onHandshake != nil {
+		o.onHandshake(hello, alpn, duration)
+	}
+}
+
+func (o observerFuncs) OnProtocolFallback(addr, from, to string) {
+	if o.onProtocolFallback != nil {
+		o.onProtocolFallback(addr, from, to)
+	}
+}
+
+func (o observerFuncs) OnRetry(attempt int, err error) {
+	if o.onRetry != nil {
+		o.onRetry(attempt, err)
+	}
+}
+
+func (o observerFuncs) OnConnectionReuse(addr, protocol string) {
+	if o.onConnectionReuse != nil {
+		o.onConnectionReuse(addr, protocol)
+	}
+}
+
+// singleConnListener is a net.Listener that yields a single already-
+// established net.Conn to its first Accept call, then reports closed.
+// It lets http.Serve own a net.Pipe end the same way it would a real
+// socket, for tests proving a dialer chain never touches the network.
+type singleConnListener struct {
+	ch chan net.Conn
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	ch := make(chan net.Conn, 1)
+	ch <- conn
+	return &singleConnListener{ch: ch}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.ch
+	if !ok {
+		return nil, errListenerClosed
+	}
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error {
+	close(l.ch)
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "singleConnListener", Net: "pipe"}
+}
@@ -0,0 +1,141 @@
+package utls
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+)
+
+// SNIMode controls how (or whether) the ClientHello's SNI extension
+// reveals the connection's real destination host.
+type SNIMode int
+
+const (
+	// SNINormal sends the real host as SNI, same as Go's default TLS
+	// stack. It is the zero value so a caller who never touches SNIPolicy
+	// gets today's behavior.
+	SNINormal SNIMode = iota
+	// SNISplit sends the ClientHello across two separate TCP segments
+	// instead of one, a known DPI-evasion technique against middleboxes
+	// that only parse the SNI extension out of a single packet.
+	SNISplit
+	// SNICover replaces the ClientHello's SNI with a caller-supplied
+	// "cover" hostname unrelated to the real Host -- domain fronting at
+	// the TLS layer, independent of HTTP-layer routing (the Host header
+	// is untouched).
+	SNICover
+	// SNIECH encrypts the real ClientHello -- including the real SNI --
+	// inside an outer ClientHello addressed to an ECH-capable front, using
+	// a caller-supplied ECHConfigList.
+	SNIECH
+)
+
+// SNIPolicy configures SNI concealment for the uTLS roundtripper. The zero
+// value (Mode: SNINormal) is a no-op.
+type SNIPolicy struct {
+	Mode SNIMode
+
+	// CoverSNI is the hostname sent as SNI when Mode is SNICover.
+	CoverSNI string
+
+	// ECHConfigList is the wire-format ECHConfigList advertised by the
+	// front used to encrypt the real ClientHello when Mode is SNIECH.
+	ECHConfigList []byte
+}
+
+// WithSNIPolicy sets the SNI concealment policy applied to every
+// connection this roundtripper dials over TCP.
+func WithSNIPolicy(policy SNIPolicy) Option {
+	return func(rt *uTLSHTTPRoundTripperImpl) {
+		rt.sniPolicy = policy
+	}
+}
+
+// cacheSuffix distinguishes connections using different SNI policies in
+// the roundtripper's connection cache, most importantly so that two
+// different cover hosts fronting the same real Host never share a cached
+// connection.
+func (p SNIPolicy) cacheSuffix() string {
+	switch p.Mode {
+	case SNICover:
+		return "cover:" + p.CoverSNI
+	case SNIECH:
+		return "ech"
+	case SNISplit:
+		return "split"
+	default:
+		return ""
+	}
+}
+
+// verifyAgainstHost verifies a certificate chain (as presented during the
+// handshake) against realHost rather than against whatever ServerName was
+// actually sent in the ClientHello. It's used when SNICover has set
+// ServerName to a front's hostname for the handshake but the caller still
+// wants the connection only trusted if it terminates at realHost.
+func verifyAgainstHost(rawCerts [][]byte, roots *x509.CertPool, realHost string) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("utls roundtripper: no certificates presented")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("utls roundtripper: parsing certificate %d: %w", i, err)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	host := realHost
+	if h, _, err := net.SplitHostPort(realHost); err == nil {
+		host = h
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("utls roundtripper: certificate not valid for %s: %w", host, err)
+	}
+	return nil
+}
+
+// splitWriteConn wraps a net.Conn so that its very first Write -- the
+// ClientHello, when placed in front of a TLS handshake -- is split across
+// two physical Write calls (and so, for a TCP socket, two segments)
+// instead of one. The split point is an offset into the record rather
+// than a parsed extension boundary; in practice the SNI extension for
+// uTLS's browser-mimicking specs falls early enough in the hello that a
+// fixed fractional offset reliably lands inside it.
+type splitWriteConn struct {
+	net.Conn
+	done bool
+}
+
+func (c *splitWriteConn) Write(b []byte) (int, error) {
+	if c.done || len(b) < 8 {
+		return c.Conn.Write(b)
+	}
+	c.done = true
+	// With Nagle's algorithm left on, the kernel is free to coalesce these
+	// two Write calls back into a single TCP segment before either hits
+	// the wire, silently undoing the split. Disable it so the segments
+	// the DPI evasion depends on actually go out separately.
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(true)
+	}
+	split := len(b) / 3
+	n1, err := c.Conn.Write(b[:split])
+	if err != nil {
+		return n1, err
+	}
+	n2, err := c.Conn.Write(b[split:])
+	return n1 + n2, err
+}
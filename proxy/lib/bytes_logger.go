@@ -0,0 +1,88 @@
+package snowflake_proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// bytesLogger is a private interface for tracking the amount of traffic
+// relayed by the SnowflakeProxy, separate from the EventLogger given to us
+// by the caller. Its sole purpose is to let webRTCConn record inbound and
+// outbound byte counts without depending on the rest of the proxy.
+type bytesLogger interface {
+	AddOutbound(int64)
+	AddInbound(int64)
+}
+
+// bytesSyncLogger is a bytesLogger that accumulates counts in memory and,
+// on every tick of period, emits an EventOnProxyStats (and, if set, invokes
+// statsCallback) summarizing the interval before resetting.
+type bytesSyncLogger struct {
+	outboundTotal   int64
+	inboundTotal    int64
+	connectionCount int64
+
+	period        time.Duration
+	eventLogger   EventLogger
+	statsCallback StatsCallback
+
+	started bool
+}
+
+func newBytesSyncLogger(eventLogger EventLogger, statsCallback StatsCallback, period time.Duration) *bytesSyncLogger {
+	b := &bytesSyncLogger{
+		period:        period,
+		eventLogger:   eventLogger,
+		statsCallback: statsCallback,
+	}
+	return b
+}
+
+func (b *bytesSyncLogger) run(shutdown chan struct{}) {
+	if b.started {
+		return
+	}
+	b.started = true
+	ticker := time.NewTicker(b.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+func (b *bytesSyncLogger) flush() {
+	inbound := atomic.SwapInt64(&b.inboundTotal, 0)
+	outbound := atomic.SwapInt64(&b.outboundTotal, 0)
+	connections := atomic.SwapInt64(&b.connectionCount, 0)
+	stats := EventOnProxyStats{
+		SummaryInterval: b.period,
+		ConnectionCount: int(connections),
+		InboundBytes:    inbound,
+		OutboundBytes:   outbound,
+	}
+	if b.eventLogger != nil {
+		b.eventLogger.OnNewSnowflakeEvent(stats)
+	}
+	if b.statsCallback != nil {
+		b.statsCallback(stats)
+	}
+}
+
+func (b *bytesSyncLogger) AddOutbound(amount int64) {
+	atomic.AddInt64(&b.outboundTotal, amount)
+}
+
+func (b *bytesSyncLogger) AddInbound(amount int64) {
+	atomic.AddInt64(&b.inboundTotal, amount)
+}
+
+// addConnection records that one client session has finished, so it's
+// reflected in the ConnectionCount of the next stats summary.
+func (b *bytesSyncLogger) addConnection() {
+	atomic.AddInt64(&b.connectionCount, 1)
+}
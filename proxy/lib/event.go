@@ -0,0 +1,105 @@
+package snowflake_proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event is implemented by every event the proxy can emit through an
+// EventLogger. Concrete types carry whatever detail is relevant to that
+// event; String() renders a one-line human-readable summary suitable for
+// logging.
+type Event interface {
+	fmt.Stringer
+	IsEvent()
+}
+
+// EventOnCurrentNATTypeDetermined fires whenever the proxy (re)classifies
+// its own NAT type via STUN probing.
+type EventOnCurrentNATTypeDetermined struct {
+	CurNATType string
+}
+
+func (e EventOnCurrentNATTypeDetermined) String() string {
+	return "NAT Type: " + e.CurNATType
+}
+func (e EventOnCurrentNATTypeDetermined) IsEvent() {}
+
+// EventOnOfferCreated fires when the proxy receives (or fails to receive) an
+// SDP offer from the broker for a new session.
+type EventOnOfferCreated struct {
+	WasRestricted bool
+	Error         error
+}
+
+func (e EventOnOfferCreated) String() string {
+	if e.Error != nil {
+		return "offer: failed to get offer: " + e.Error.Error()
+	}
+	return "offer: received"
+}
+func (e EventOnOfferCreated) IsEvent() {}
+
+// EventOnSnowflakeConnected fires once a client's DataChannel reaches the
+// open state and the session is considered established.
+type EventOnSnowflakeConnected struct{}
+
+func (e EventOnSnowflakeConnected) String() string {
+	return "connected"
+}
+func (e EventOnSnowflakeConnected) IsEvent() {}
+
+// EventOnSnowflakeConnectionFailed fires when a session ends before a
+// DataChannel ever opened (broker error, timeout, or ICE failure).
+type EventOnSnowflakeConnectionFailed struct {
+	Error error
+}
+
+func (e EventOnSnowflakeConnectionFailed) String() string {
+	return "connection failed: " + e.Error.Error()
+}
+func (e EventOnSnowflakeConnectionFailed) IsEvent() {}
+
+// EventOnProxyConnectionOver fires once a client session (relay <->
+// datachannel copy loop) has finished, carrying the totals for that one
+// session.
+type EventOnProxyConnectionOver struct {
+	InboundBytes, OutboundBytes int64
+}
+
+func (e EventOnProxyConnectionOver) String() string {
+	return fmt.Sprintf("connection closed, in: %d B, out: %d B", e.InboundBytes, e.OutboundBytes)
+}
+func (e EventOnProxyConnectionOver) IsEvent() {}
+
+// EventOnProxyStats fires periodically with a rolling summary across all
+// sessions, suitable for driving a UI without the caller having to track
+// per-session events itself.
+type EventOnProxyStats struct {
+	SummaryInterval             time.Duration
+	ConnectionCount             int
+	InboundBytes, OutboundBytes int64
+}
+
+func (e EventOnProxyStats) String() string {
+	return fmt.Sprintf(
+		"In the last %v, there were %d completed connections. Traffic Relayed ↑ %d B, ↓ %d B.",
+		e.SummaryInterval, e.ConnectionCount, e.OutboundBytes, e.InboundBytes,
+	)
+}
+func (e EventOnProxyStats) IsEvent() {}
+
+// EventLogger lets an embedding application observe what the proxy is
+// doing without scraping log output. Implementations must not block for
+// long, since OnNewSnowflakeEvent is called synchronously from the
+// goroutine that produced the event (a session, the NAT prober, or the
+// stats logger).
+type EventLogger interface {
+	OnNewSnowflakeEvent(e Event)
+}
+
+// StatsCallback is invoked with a freshly-assembled EventOnProxyStats every
+// time the proxy's periodic stats window rolls over. It is a convenience
+// for callers who only care about the rolling summary and would otherwise
+// have to filter OnNewSnowflakeEvent for EventOnProxyStats themselves.
+type StatsCallback func(EventOnProxyStats)
@@ -0,0 +1,128 @@
+package snowflake_proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/nat"
+)
+
+// iceServerHealthCheckInterval is how often each configured STUN/TURN
+// server is re-probed for reachability and NAT-behavior compatibility.
+const iceServerHealthCheckInterval = 5 * time.Minute
+
+// iceServerState tracks the result of the last health check performed
+// against one configured ICE server.
+type iceServerState struct {
+	server webrtc.ICEServer
+
+	lock          sync.Mutex
+	healthy       bool
+	restrictedNAT bool
+	lastChecked   time.Time
+}
+
+// iceServerPool health-checks a set of STUN/TURN servers and hands back
+// only the ones currently believed to be reachable, so a single blocked or
+// overloaded server doesn't take down ICE gathering for every session.
+type iceServerPool struct {
+	servers []*iceServerState
+}
+
+func newICEServerPool(iceServers []webrtc.ICEServer) *iceServerPool {
+	p := &iceServerPool{}
+	for _, s := range iceServers {
+		p.servers = append(p.servers, &iceServerState{server: s, healthy: true})
+	}
+	return p
+}
+
+// healthyICEServers returns the subset of the pool's servers whose most
+// recent probe succeeded. If every server is currently marked unhealthy,
+// it falls back to returning the whole pool rather than leaving ICE
+// gathering with no servers at all.
+func (p *iceServerPool) healthyICEServers() []webrtc.ICEServer {
+	var healthy []webrtc.ICEServer
+	var all []webrtc.ICEServer
+	for _, s := range p.servers {
+		s.lock.Lock()
+		isHealthy := s.healthy
+		s.lock.Unlock()
+		all = append(all, s.server)
+		if isHealthy {
+			healthy = append(healthy, s.server)
+		}
+	}
+	if len(healthy) == 0 {
+		return all
+	}
+	return healthy
+}
+
+// probe re-checks every server in the pool, updating each iceServerState
+// and returning the aggregate NAT classification of the first server that
+// answered. It is the multi-server analogue of the old single-STUN-URL
+// updateNATType.
+func (p *iceServerPool) probe() (natType string) {
+	natType = NATUnknown
+	for _, s := range p.servers {
+		addr := stunAddrOf(s.server)
+		if addr == "" {
+			// TURN servers (or anything without a bare STUN URL) are
+			// assumed reachable; only STUN probing tells us NAT type.
+			continue
+		}
+		restricted, err := nat.CheckIfRestrictedNAT(addr)
+		s.lock.Lock()
+		s.lastChecked = time.Now()
+		s.healthy = err == nil
+		s.restrictedNAT = restricted
+		s.lock.Unlock()
+		if err == nil && natType == NATUnknown {
+			if restricted {
+				natType = NATRestricted
+			} else {
+				natType = NATUnrestricted
+			}
+		}
+	}
+	return natType
+}
+
+// run probes every server in the pool once immediately -- so a caller that
+// launches run in a goroutine doesn't have to block on the first probe
+// itself -- and then again on every tick of iceServerHealthCheckInterval
+// until shutdown is closed.
+func (p *iceServerPool) run(shutdown chan struct{}, onProbe func(natType string)) {
+	if onProbe != nil {
+		onProbe(p.probe())
+	} else {
+		p.probe()
+	}
+
+	ticker := time.NewTicker(iceServerHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			if onProbe != nil {
+				onProbe(p.probe())
+			} else {
+				p.probe()
+			}
+		}
+	}
+}
+
+func stunAddrOf(server webrtc.ICEServer) string {
+	for _, u := range server.URLs {
+		if len(u) > 5 && u[:5] == "stun:" {
+			return u[5:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,742 @@
+// Package snowflake_proxy provides an embeddable snowflake proxy that can
+// be run in-process by third-party Go applications (for example VPN
+// clients) instead of only as the standalone snowflake-proxy binary.
+package snowflake_proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/time/rate"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/messages"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/util"
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/websocketconn"
+)
+
+const (
+	DefaultBrokerURL   = "https://snowflake-broker.torproject.net/"
+	DefaultRelayURL    = "wss://snowflake.torproject.net/"
+	DefaultSTUNURL     = "stun:stun.l.google.com:19302"
+	DefaultNATProbeURL = "https://snowflake-broker.torproject.net:8443/probe"
+	DefaultProxyType   = "standalone"
+
+	pollInterval = 5 * time.Second
+
+	NATUnknown      = "unknown"
+	NATRestricted   = "restricted"
+	NATUnrestricted = "unrestricted"
+
+	// dataChannelTimeout is how long the proxy waits, after sending an SDP
+	// answer, for the client's DataChannel to actually open before giving
+	// up and returning the capacity token.
+	dataChannelTimeout = 20 * time.Second
+
+	readLimit       = 100000 // maximum number of bytes read from a single broker HTTP response
+	sessionIDLength = 16
+
+	statsInterval = 1 * time.Hour
+
+	// unlimitedTokens bounds the capacity semaphore when Capacity is 0
+	// ("unlimited"). getToken must still block pollAndServe's spawn loop
+	// -- a nil tokens channel makes getToken a no-op and turns
+	// pollAndServe into an unthrottled, CPU-spinning busy-loop -- so this
+	// is just large enough that no real deployment will ever exhaust it.
+	unlimitedTokens = 1 << 16
+)
+
+// SnowflakeProxy is an embeddable snowflake proxy. The zero value is not
+// ready to use; construct one with the exported fields set as desired and
+// then call Start. All fields must be set before Start is called and must
+// not be mutated directly afterwards; the rate caps can be changed on a
+// running proxy through SetMaxClientRate and SetMaxTotalRate, and any
+// other change of configuration needs the proxy Stopped and a new one
+// started.
+type SnowflakeProxy struct {
+	// BrokerURL is the URL of the snowflake broker that hands out client
+	// offers. Defaults to DefaultBrokerURL if empty.
+	BrokerURL string
+	// RelayURL is the websocket URL of the relay that client traffic is
+	// forwarded to. Defaults to DefaultRelayURL if empty.
+	RelayURL string
+	// STUNURLs is the list of STUN server URLs used both for NAT probing
+	// and for ICE gathering. Defaults to []string{DefaultSTUNURL} if empty.
+	STUNURLs []string
+	// TURNServers is an optional list of TURN servers (with credentials)
+	// added to the ICE server pool alongside STUNURLs. Unlike STUN servers
+	// they are not used for NAT-type probing, only for ICE gathering.
+	TURNServers []webrtc.ICEServer
+	// NATProbeURL is the URL of a NAT-check service. Defaults to
+	// DefaultNATProbeURL if empty. It is not contacted: the proxy's own NAT
+	// type is classified only by STUN probing of STUNURLs.
+	NATProbeURL string
+	// ProxyType is reported to the broker on every poll, identifying this
+	// proxy's deployment ("standalone", "badge", "webext", ...). Defaults
+	// to DefaultProxyType if empty.
+	ProxyType string
+	// Capacity is the maximum number of concurrent client sessions this
+	// proxy will serve. A value of 0 means unlimited.
+	Capacity uint
+	// KeepLocalAddresses, if true, leaves LAN ICE candidates in the SDP
+	// answer sent to the broker instead of stripping them.
+	KeepLocalAddresses bool
+
+	// MaxClientRate caps the outbound (proxy-to-client) rate of any single
+	// datachannel, in bytes per second. Zero means unlimited.
+	MaxClientRate int
+	// MaxTotalRate caps the combined outbound rate across every
+	// datachannel this proxy is serving, in bytes per second. Zero means
+	// unlimited.
+	MaxTotalRate int
+
+	// EphemeralMinPort and EphemeralMaxPort, if both non-zero, restrict
+	// the UDP port range used for ICE candidates via pion's SettingEngine.
+	EphemeralMinPort, EphemeralMaxPort uint16
+	// ICEInterface, if set, restricts ICE candidate gathering to a single
+	// network interface (by name, e.g. "eth0") or local IP address (e.g.
+	// "203.0.113.7"). Useful on multi-homed hosts where only one
+	// interface should carry snowflake traffic.
+	ICEInterface string
+
+	// EventLogger, if non-nil, is notified of every Event the proxy
+	// produces: NAT classification, per-session connect/disconnect, and
+	// periodic traffic summaries.
+	EventLogger EventLogger
+	// StatsCallback, if non-nil, is invoked with a fresh EventOnProxyStats
+	// every time the periodic stats window rolls over. It is a
+	// convenience for callers that only want the rolling summary.
+	StatsCallback StatsCallback
+
+	broker      *broker
+	icePool     *iceServerPool
+	turboTunnel *turboTunnelManager
+	webrtcAPI   *webrtc.API
+
+	limiterLock   sync.Mutex
+	globalLimiter *rate.Limiter
+
+	bytesLogger *bytesSyncLogger
+
+	tokens chan bool
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+
+	currentNATTypeLock sync.Mutex
+	currentNATType     string
+}
+
+// Start begins polling the broker for clients and serving them until Stop
+// is called. It returns once the proxy's background goroutines have been
+// launched; it does not block.
+func (sf *SnowflakeProxy) Start() error {
+	sf.shutdown = make(chan struct{})
+
+	if sf.BrokerURL == "" {
+		sf.BrokerURL = DefaultBrokerURL
+	}
+	if sf.RelayURL == "" {
+		sf.RelayURL = DefaultRelayURL
+	}
+	if len(sf.STUNURLs) == 0 {
+		sf.STUNURLs = []string{DefaultSTUNURL}
+	}
+	if sf.NATProbeURL == "" {
+		sf.NATProbeURL = DefaultNATProbeURL
+	}
+	if sf.ProxyType == "" {
+		sf.ProxyType = DefaultProxyType
+	}
+
+	brokerURL, err := url.Parse(sf.BrokerURL)
+	if err != nil {
+		return fmt.Errorf("invalid broker url: %s", err)
+	}
+	if _, err := url.Parse(sf.RelayURL); err != nil {
+		return fmt.Errorf("invalid relay url: %s", err)
+	}
+
+	// Clone rather than mutate http.DefaultTransport: as an embeddable
+	// library, this must not reach into the whole process's shared
+	// default transport and change a third-party app's global timeout.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 15 * time.Second
+	sf.broker = &broker{
+		url:                brokerURL,
+		transport:          transport,
+		keepLocalAddresses: sf.KeepLocalAddresses,
+	}
+
+	sf.webrtcAPI, err = sf.newWebRTCAPI()
+	if err != nil {
+		return fmt.Errorf("invalid ICE configuration: %s", err)
+	}
+
+	var iceServers []webrtc.ICEServer
+	for _, stunURL := range sf.STUNURLs {
+		iceServers = append(iceServers, webrtc.ICEServer{URLs: []string{stunURL}})
+	}
+	iceServers = append(iceServers, sf.TURNServers...)
+	sf.icePool = newICEServerPool(iceServers)
+
+	sf.currentNATType = NATUnknown
+
+	sf.wg.Add(1)
+	go func() {
+		defer sf.wg.Done()
+		// icePool.run does the initial probe itself, before its first
+		// ticker tick, so Start can launch it and return immediately
+		// instead of blocking here on STUN round-trips.
+		sf.icePool.run(sf.shutdown, func(natType string) {
+			sf.currentNATTypeLock.Lock()
+			sf.currentNATType = natType
+			sf.currentNATTypeLock.Unlock()
+			sf.emit(EventOnCurrentNATTypeDetermined{CurNATType: natType})
+		})
+	}()
+
+	sf.bytesLogger = newBytesSyncLogger(sf.EventLogger, sf.StatsCallback, statsInterval)
+	sf.wg.Add(1)
+	go func() {
+		defer sf.wg.Done()
+		sf.bytesLogger.run(sf.shutdown)
+	}()
+
+	if sf.MaxTotalRate > 0 {
+		sf.globalLimiter = newRateLimiter(sf.MaxTotalRate)
+	}
+
+	sf.turboTunnel = newTurboTunnelManager(sf.RelayURL)
+	sf.wg.Add(1)
+	go func() {
+		defer sf.wg.Done()
+		sf.turboTunnel.run(sf.shutdown)
+	}()
+
+	capacity := sf.Capacity
+	if capacity == 0 {
+		capacity = unlimitedTokens
+	}
+	sf.tokens = make(chan bool, capacity)
+	for i := uint(0); i < capacity; i++ {
+		sf.tokens <- true
+	}
+
+	sf.wg.Add(1)
+	go func() {
+		defer sf.wg.Done()
+		sf.pollAndServe()
+	}()
+
+	return nil
+}
+
+// Stop tells the proxy to stop polling the broker and closes all sessions
+// currently in progress, then waits for its background goroutines to
+// finish.
+func (sf *SnowflakeProxy) Stop() {
+	close(sf.shutdown)
+	sf.wg.Wait()
+}
+
+func (sf *SnowflakeProxy) getToken() {
+	select {
+	case <-sf.tokens:
+	case <-sf.shutdown:
+	}
+}
+
+func (sf *SnowflakeProxy) retToken() {
+	select {
+	case sf.tokens <- true:
+	default:
+	}
+}
+
+func (sf *SnowflakeProxy) pollAndServe() {
+	for {
+		select {
+		case <-sf.shutdown:
+			return
+		default:
+		}
+		sf.getToken()
+		select {
+		case <-sf.shutdown:
+			return
+		default:
+		}
+		sessionID := genSessionID()
+		go sf.runSession(sessionID)
+	}
+}
+
+func (sf *SnowflakeProxy) emit(e Event) {
+	if sf.EventLogger != nil {
+		sf.EventLogger.OnNewSnowflakeEvent(e)
+	}
+}
+
+func (sf *SnowflakeProxy) getNATType() string {
+	sf.currentNATTypeLock.Lock()
+	defer sf.currentNATTypeLock.Unlock()
+	return sf.currentNATType
+}
+
+// SetMaxTotalRate changes the aggregate outbound rate cap across every
+// datachannel this proxy is serving, in bytes per second. It takes effect
+// immediately, including for connections already in progress. A value of
+// 0 or less removes the cap.
+func (sf *SnowflakeProxy) SetMaxTotalRate(bytesPerSecond int) {
+	sf.limiterLock.Lock()
+	defer sf.limiterLock.Unlock()
+	sf.MaxTotalRate = bytesPerSecond
+	if bytesPerSecond <= 0 {
+		sf.globalLimiter = nil
+		return
+	}
+	if sf.globalLimiter == nil {
+		sf.globalLimiter = newRateLimiter(bytesPerSecond)
+		return
+	}
+	sf.globalLimiter.SetLimit(rate.Limit(bytesPerSecond))
+	sf.globalLimiter.SetBurst(limiterBurst(bytesPerSecond))
+}
+
+// SetMaxClientRate changes the per-datachannel outbound rate cap, in
+// bytes per second. A value of 0 or less removes the cap. It only applies
+// to datachannels opened after the call; connections already in progress
+// keep whatever limiter they were given when they were created.
+func (sf *SnowflakeProxy) SetMaxClientRate(bytesPerSecond int) {
+	sf.limiterLock.Lock()
+	defer sf.limiterLock.Unlock()
+	sf.MaxClientRate = bytesPerSecond
+}
+
+func (sf *SnowflakeProxy) newClientLimiter() *rate.Limiter {
+	sf.limiterLock.Lock()
+	defer sf.limiterLock.Unlock()
+	if sf.MaxClientRate <= 0 {
+		return nil
+	}
+	return newRateLimiter(sf.MaxClientRate)
+}
+
+func (sf *SnowflakeProxy) getGlobalLimiter() *rate.Limiter {
+	sf.limiterLock.Lock()
+	defer sf.limiterLock.Unlock()
+	return sf.globalLimiter
+}
+
+func limiterBurst(bytesPerSecond int) int {
+	const minBurst = 16 * 1024
+	if bytesPerSecond < minBurst {
+		return minBurst
+	}
+	return bytesPerSecond
+}
+
+func newRateLimiter(bytesPerSecond int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), limiterBurst(bytesPerSecond))
+}
+
+func genSessionID() string {
+	buf := make([]byte, sessionIDLength)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err.Error())
+	}
+	return strings.TrimRight(base64.StdEncoding.EncodeToString(buf), "=")
+}
+
+func limitedRead(r io.Reader, limit int64) ([]byte, error) {
+	p, err := io.ReadAll(&io.LimitedReader{R: r, N: limit + 1})
+	if err != nil {
+		return p, err
+	} else if int64(len(p)) == limit+1 {
+		return p[0:limit], io.ErrUnexpectedEOF
+	}
+	return p, err
+}
+
+// broker is a thin client for the two broker HTTP endpoints the proxy
+// uses: polling for a waiting client's offer, and posting back an answer.
+type broker struct {
+	url                *url.URL
+	transport          http.RoundTripper
+	keepLocalAddresses bool
+}
+
+func (sf *SnowflakeProxy) pollOffer(sid string) *webrtc.SessionDescription {
+	b := sf.broker
+	brokerPath := b.url.ResolveReference(&url.URL{Path: "proxy"})
+	timeOfNextPoll := time.Now()
+	for {
+		select {
+		case <-sf.shutdown:
+			return nil
+		default:
+		}
+
+		now := time.Now()
+		time.Sleep(timeOfNextPoll.Sub(now))
+		timeOfNextPoll = timeOfNextPoll.Add(pollInterval)
+		if timeOfNextPoll.Before(now) {
+			timeOfNextPoll = now
+		}
+
+		body, err := messages.EncodePollRequest(sid, sf.ProxyType, sf.getNATType())
+		if err != nil {
+			sf.emit(EventOnOfferCreated{Error: fmt.Errorf("error encoding poll message: %s", err)})
+			return nil
+		}
+		req, _ := http.NewRequest("POST", brokerPath.String(), strings.NewReader(string(body)))
+		resp, err := b.transport.RoundTrip(req)
+		if err != nil {
+			log.Printf("error polling broker: %s", err)
+			continue
+		}
+		sdp := sf.handlePollResponse(resp)
+		if sdp != nil {
+			return sdp
+		}
+	}
+}
+
+func (sf *SnowflakeProxy) handlePollResponse(resp *http.Response) *webrtc.SessionDescription {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("broker returns: %d", resp.StatusCode)
+		return nil
+	}
+	respBody, err := limitedRead(resp.Body, readLimit)
+	if err != nil {
+		log.Printf("error reading broker response: %s", err)
+		return nil
+	}
+	offer, _, err := messages.DecodePollResponse(respBody)
+	if err != nil {
+		log.Printf("error reading broker response: %s", err.Error())
+		return nil
+	}
+	if offer == "" {
+		return nil
+	}
+	sdp, err := util.DeserializeSessionDescription(offer)
+	if err != nil {
+		sf.emit(EventOnOfferCreated{WasRestricted: sf.getNATType() == NATRestricted, Error: fmt.Errorf("error processing session description: %s", err)})
+		return nil
+	}
+	sf.emit(EventOnOfferCreated{WasRestricted: sf.getNATType() == NATRestricted})
+	return sdp
+}
+
+func (sf *SnowflakeProxy) sendAnswer(sid string, pc *webrtc.PeerConnection) error {
+	b := sf.broker
+	brokerPath := b.url.ResolveReference(&url.URL{Path: "answer"})
+	ld := pc.LocalDescription()
+	if !b.keepLocalAddresses {
+		ld = &webrtc.SessionDescription{
+			Type: ld.Type,
+			SDP:  util.StripLocalAddresses(ld.SDP),
+		}
+	}
+	answer, err := util.SerializeSessionDescription(ld)
+	if err != nil {
+		return err
+	}
+	body, err := messages.EncodeAnswerRequest(answer, sid)
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequest("POST", brokerPath.String(), strings.NewReader(string(body)))
+	resp, err := b.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("broker returned %d", resp.StatusCode)
+	}
+	respBody, err := limitedRead(resp.Body, readLimit)
+	if err != nil {
+		return fmt.Errorf("error reading broker response: %s", err)
+	}
+	success, err := messages.DecodeAnswerResponse(respBody)
+	if err != nil {
+		return err
+	}
+	if !success {
+		return fmt.Errorf("broker returned client timeout")
+	}
+	return nil
+}
+
+// CopyLoop copies bytes in both directions between c1 and c2 until either
+// side is closed or returns an error.
+func CopyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	copyer := func(dst io.ReadWriteCloser, src io.ReadWriteCloser) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			log.Printf("io.Copy inside CopyLoop generated an error: %v", err)
+		}
+		dst.Close()
+		src.Close()
+	}
+	wg.Add(2)
+	go copyer(c1, c2)
+	go copyer(c2, c1)
+	wg.Wait()
+}
+
+// We pass remoteAddr as an explicit parameter, rather than calling
+// conn.RemoteIP() inside this function, as a workaround for a hang that
+// otherwise occurs inside of conn.pc.RemoteDescription() (called by
+// RemoteIP). https://bugs.torproject.org/18628#comment:8
+//
+// tokenOnce guards the capacity token for this session: datachannelHandler
+// and runSession race to return it (a client can close its DataChannel
+// before SCTP ever finishes opening, running both the OnClose teardown and
+// the dataChannelTimeout branch), and the token must be returned exactly
+// once.
+func (sf *SnowflakeProxy) datachannelHandler(conn *webRTCConn, remoteIP net.IP, tokenOnce *sync.Once) {
+	defer conn.Close()
+	defer tokenOnce.Do(sf.retToken)
+	defer sf.bytesLogger.addConnection()
+	defer func() {
+		inbound, outbound := conn.bytesTransferred()
+		sf.emit(EventOnProxyConnectionOver{InboundBytes: inbound, OutboundBytes: outbound})
+	}()
+
+	// Close the connection if the proxy is stopped while this session is
+	// still relaying, so Stop ends sessions in progress.
+	handlerDone := make(chan struct{})
+	defer close(handlerDone)
+	go func() {
+		select {
+		case <-sf.shutdown:
+			conn.Close()
+		case <-handlerDone:
+		}
+	}()
+
+	var clientIP string
+	if remoteIP != nil {
+		clientIP = remoteIP.String()
+	} else {
+		log.Printf("no remote address given in websocket")
+	}
+
+	// Sniff the first bytes off the datachannel for a Turbo Tunnel client
+	// ID header before handing it to a relay copier. The peeked bytes are
+	// always replayed to whichever path handles the connection below, so
+	// this is transparent to clients that don't speak Turbo Tunnel.
+	peekBuf := make([]byte, turboTunnelHeaderLength)
+	n, err := io.ReadFull(conn, peekBuf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		log.Printf("error peeking datachannel: %s", err)
+		return
+	}
+	id, leftover, isTurboTunnel := peekTurboTunnelHeader(peekBuf[:n])
+	sniffedConn := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{&prefixedReader{prefix: leftover, r: conn}, conn, conn}
+
+	if isTurboTunnel {
+		log.Printf("turbo tunnel datachannel for client %x", id)
+		if err := sf.turboTunnel.serveDataChannel(id, clientIP, sniffedConn); err != nil {
+			log.Printf("turbo tunnel session error: %s", err)
+		}
+		log.Printf("datachannelHandler ends")
+		return
+	}
+
+	u, err := url.Parse(sf.RelayURL)
+	if err != nil {
+		log.Printf("invalid relay url: %s", err)
+		return
+	}
+	if clientIP != "" {
+		q := u.Query()
+		q.Set("client_ip", clientIP)
+		u.RawQuery = q.Encode()
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		log.Printf("error dialing relay: %s", err)
+		return
+	}
+	wsConn := websocketconn.New(ws)
+	log.Printf("connected to relay")
+	defer wsConn.Close()
+	CopyLoop(sniffedConn, wsConn)
+	log.Printf("datachannelHandler ends")
+}
+
+// makePeerConnectionFromOffer creates a PeerConnection from an SDP offer.
+// It blocks until ICE gathering is complete and the answer is available in
+// LocalDescription. It installs an OnDataChannel callback that creates a
+// webRTCConn and hands it to datachannelHandler right away; dataChan is
+// closed only once the channel opens.
+func (sf *SnowflakeProxy) makePeerConnectionFromOffer(
+	sdp *webrtc.SessionDescription,
+	config webrtc.Configuration,
+	dataChan chan struct{},
+	tokenOnce *sync.Once,
+) (*webrtc.PeerConnection, error) {
+	pc, err := sf.webrtcAPI.NewPeerConnection(config)
+	if err != nil {
+		return nil, fmt.Errorf("accept: NewPeerConnection: %s", err)
+	}
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		log.Println("OnDataChannel")
+
+		pr, pw := io.Pipe()
+		conn := newWebRTCConn(pc, dc, pr, sf.bytesLogger)
+		conn.clientLimiter = sf.newClientLimiter()
+		conn.globalLimiter = sf.getGlobalLimiter()
+
+		dc.SetBufferedAmountLowThreshold(maxBufferedAmount / 2)
+		dc.OnBufferedAmountLow(func() {
+			select {
+			case conn.sendMoreCh <- struct{}{}:
+			default:
+			}
+		})
+
+		dc.OnOpen(func() {
+			log.Println("OnOpen channel")
+			close(dataChan)
+		})
+		dc.OnClose(func() {
+			conn.lock.Lock()
+			log.Println("OnClose channel")
+			conn.dc = nil
+			dc.Close()
+			pw.Close()
+			conn.lock.Unlock()
+			// Tear down promptly: a client that opens and immediately
+			// closes its datachannel would otherwise sit on a webRTCConn
+			// (and the capacity token it holds via datachannelHandler)
+			// until the inactivity timeout expired.
+			conn.Close()
+		})
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var n int
+			n, err = pw.Write(msg.Data)
+			if err != nil {
+				if inerr := pw.CloseWithError(err); inerr != nil {
+					log.Printf("close with error generated an error: %v", inerr)
+				}
+			}
+			if n != len(msg.Data) {
+				panic("short write")
+			}
+		})
+
+		go sf.datachannelHandler(conn, conn.RemoteIP(), tokenOnce)
+	})
+
+	err = pc.SetRemoteDescription(*sdp)
+	if err != nil {
+		if inerr := pc.Close(); inerr != nil {
+			log.Printf("unable to call pc.Close after pc.SetRemoteDescription with error: %v", inerr)
+		}
+		return nil, fmt.Errorf("accept: SetRemoteDescription: %s", err)
+	}
+	log.Println("sdp offer successfully received.")
+
+	log.Println("Generating answer...")
+	answer, err := pc.CreateAnswer(nil)
+	// blocks on ICE gathering. we need to add a timeout if needed
+	// not putting this in a separate go routine, because we need
+	// SetLocalDescription(answer) to be called before sendAnswer
+	if err != nil {
+		if inerr := pc.Close(); inerr != nil {
+			log.Printf("ICE gathering has generated an error when calling pc.Close: %v", inerr)
+		}
+		return nil, err
+	}
+
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		if err = pc.Close(); err != nil {
+			log.Printf("pc.Close after setting local description returned : %v", err)
+		}
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+func (sf *SnowflakeProxy) runSession(sid string) {
+	// tokenOnce ensures the capacity token acquired for this session is
+	// returned exactly once, however the session ends: here, or inside
+	// datachannelHandler once the client's DataChannel has arrived.
+	var tokenOnce sync.Once
+	offer := sf.pollOffer(sid)
+	if offer == nil {
+		log.Printf("bad offer from broker")
+		tokenOnce.Do(sf.retToken)
+		return
+	}
+	dataChan := make(chan struct{})
+	config := webrtc.Configuration{ICEServers: sf.icePool.healthyICEServers()}
+	pc, err := sf.makePeerConnectionFromOffer(offer, config, dataChan, &tokenOnce)
+	if err != nil {
+		sf.emit(EventOnSnowflakeConnectionFailed{Error: err})
+		log.Printf("error making WebRTC connection: %s", err)
+		tokenOnce.Do(sf.retToken)
+		return
+	}
+	err = sf.sendAnswer(sid, pc)
+	if err != nil {
+		sf.emit(EventOnSnowflakeConnectionFailed{Error: err})
+		log.Printf("error sending answer to client through broker: %s", err)
+		if inerr := pc.Close(); inerr != nil {
+			log.Printf("error calling pc.Close: %v", inerr)
+		}
+		tokenOnce.Do(sf.retToken)
+		return
+	}
+	// Set a timeout on peerconnection. If the DataChannel has not reached
+	// the open state in this time, destroy the peer connection and return
+	// the token.
+	select {
+	case <-dataChan:
+		sf.emit(EventOnSnowflakeConnected{})
+		log.Println("Connection successful.")
+	case <-time.After(dataChannelTimeout):
+		sf.emit(EventOnSnowflakeConnectionFailed{Error: fmt.Errorf("timed out waiting for DataChannel to open")})
+		log.Println("Timed out waiting for client to open data channel.")
+		if err := pc.Close(); err != nil {
+			log.Printf("error calling pc.Close: %v", err)
+		}
+		tokenOnce.Do(sf.retToken)
+	case <-sf.shutdown:
+		if err := pc.Close(); err != nil {
+			log.Printf("error calling pc.Close: %v", err)
+		}
+		tokenOnce.Do(sf.retToken)
+	}
+}
+
+// isRemoteAddress reports whether ip is routable, i.e. not a loopback,
+// unspecified, or local-network address.
+func isRemoteAddress(ip net.IP) bool {
+	return !(util.IsLocal(ip) || ip.IsUnspecified() || ip.IsLoopback())
+}
@@ -0,0 +1,297 @@
+package snowflake_proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/v2/common/websocketconn"
+)
+
+// turboTunnelMagic prefixes a Turbo Tunnel client ID on the very first
+// message of a datachannel. Its presence tells the proxy that this
+// datachannel is one leg of a longer-lived logical client session that may
+// be resumed over a different datachannel -- even through a different
+// proxy -- rather than a one-shot connection.
+var turboTunnelMagic = [8]byte{0x53, 0x6e, 0x6f, 0x77, 0x54, 0x54, 0x30, 0x31} // "SnowTT01"
+
+const clientIDLength = 8
+
+type clientID [clientIDLength]byte
+
+const turboTunnelHeaderLength = len(turboTunnelMagic) + clientIDLength
+
+// turboTunnelIdleTimeout is how long a sessionState is kept around with no
+// attached datachannel before it is garbage collected.
+const turboTunnelIdleTimeout = 2 * time.Minute
+
+// sessionState is the proxy-side half of one logical Turbo Tunnel client
+// session: a single persistent websocket connection to the relay, addressed
+// by the client's session_id, that survives across however many
+// datachannels attach to it over time -- even ones that land on this proxy
+// after a different snowflake died. The relay, not this proxy, owns the
+// actual KCP session; the proxy's only job is to keep relayConn open and
+// forward raw bytes between it and whichever datachannel is currently
+// attached, so the session the relay is tracking is never terminated here.
+type sessionState struct {
+	id  clientID
+	mgr *turboTunnelManager
+
+	relayConn io.ReadWriteCloser
+
+	lock         sync.Mutex
+	lastActivity time.Time
+	// attached is the datachannel currently receiving bytes read from
+	// relayConn. It is swapped, not torn down, when a client resumes the
+	// session through a new datachannel; nil between attachments, in
+	// which case relayPump simply drops relay traffic until one attaches.
+	// It is closed, not just dropped, when relayConn itself dies, so the
+	// datachannel's own copy loop unblocks and tears that connection down
+	// instead of leaking it.
+	attached io.WriteCloser
+}
+
+func (s *sessionState) touch() {
+	s.lock.Lock()
+	s.lastActivity = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *sessionState) idleSince() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Since(s.lastActivity)
+}
+
+func (s *sessionState) Close() error {
+	return s.relayConn.Close()
+}
+
+// attach makes w the destination for bytes relayPump reads off relayConn,
+// replacing whatever datachannel was previously attached (if any).
+func (s *sessionState) attach(w io.WriteCloser) {
+	s.lock.Lock()
+	s.attached = w
+	s.lock.Unlock()
+}
+
+// detach clears the attached writer, but only if it's still w -- a newer
+// datachannel may have already taken over the session by the time an
+// older one's copy loop notices it ended.
+func (s *sessionState) detach(w io.WriteCloser) {
+	s.lock.Lock()
+	if s.attached == w {
+		s.attached = nil
+	}
+	s.lock.Unlock()
+}
+
+// relayPump reads bytes off relayConn for as long as the session lives and
+// writes them to whichever datachannel is currently attached, dropping
+// them on the floor when none is (e.g. between a client's proxy handoffs).
+// It returns once relayConn itself fails, which means the relay has ended
+// the underlying KCP session and this sessionState is no longer usable:
+// it closes relayConn and the attached datachannel (if any), so that
+// datachannel's own copy loop unblocks and tears its connection down
+// instead of leaking it, and removes itself from mgr's session table so
+// the next datachannel for this client ID dials a fresh relay connection
+// instead of reusing this dead one.
+func (s *sessionState) relayPump() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := s.relayConn.Read(buf)
+		if n > 0 {
+			s.lock.Lock()
+			w := s.attached
+			s.lock.Unlock()
+			if w != nil {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					s.detach(w)
+				}
+			}
+		}
+		if err != nil {
+			s.Close()
+			s.lock.Lock()
+			w := s.attached
+			s.attached = nil
+			s.lock.Unlock()
+			if w != nil {
+				w.Close()
+			}
+			s.mgr.removeIfCurrent(s.id, s)
+			return
+		}
+	}
+}
+
+// turboTunnelManager owns every sessionState currently known to this
+// proxy process, keyed by client ID, and garbage-collects idle ones.
+type turboTunnelManager struct {
+	relayURL string
+
+	lock     sync.Mutex
+	sessions map[clientID]*sessionState
+}
+
+func newTurboTunnelManager(relayURL string) *turboTunnelManager {
+	return &turboTunnelManager{
+		relayURL: relayURL,
+		sessions: make(map[clientID]*sessionState),
+	}
+}
+
+func (m *turboTunnelManager) run(shutdown chan struct{}) {
+	ticker := time.NewTicker(turboTunnelIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			m.closeAll()
+			return
+		case <-ticker.C:
+			m.reapIdle()
+		}
+	}
+}
+
+func (m *turboTunnelManager) reapIdle() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, s := range m.sessions {
+		s.lock.Lock()
+		attached := s.attached != nil
+		s.lock.Unlock()
+		if !attached && s.idleSince() > turboTunnelIdleTimeout {
+			s.Close()
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *turboTunnelManager) closeAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, s := range m.sessions {
+		s.Close()
+		delete(m.sessions, id)
+	}
+}
+
+// removeIfCurrent drops id from sessions, but only if it's still mapped to
+// s -- sessionFor's dial race already guards against double-insertion, and
+// this is the same guard for the teardown side, so a dead sessionState
+// can't clobber a fresher one a concurrent dial just installed.
+func (m *turboTunnelManager) removeIfCurrent(id clientID, s *sessionState) {
+	m.lock.Lock()
+	if m.sessions[id] == s {
+		delete(m.sessions, id)
+	}
+	m.lock.Unlock()
+}
+
+// sessionFor returns the sessionState for id, dialing a fresh persistent
+// websocket to the relay if one doesn't already exist for that client ID,
+// and attaches conn to it as the current destination for relay->client
+// bytes. Attaching here, before relayPump is started on a freshly dialed
+// session, closes the window in which relay bytes could otherwise arrive
+// before any datachannel was attached to receive them.
+func (m *turboTunnelManager) sessionFor(id clientID, clientIP string, conn io.WriteCloser) (*sessionState, error) {
+	m.lock.Lock()
+	if s, ok := m.sessions[id]; ok {
+		m.lock.Unlock()
+		s.attach(conn)
+		s.touch()
+		return s, nil
+	}
+	m.lock.Unlock()
+
+	u, err := url.Parse(m.relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay url: %w", err)
+	}
+	q := u.Query()
+	if clientIP != "" {
+		q.Set("client_ip", clientIP)
+	}
+	q.Set("session_id", fmt.Sprintf("%x", id))
+	u.RawQuery = q.Encode()
+
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing relay for turbo tunnel session: %w", err)
+	}
+	relayConn := websocketconn.New(ws)
+
+	s := &sessionState{id: id, mgr: m, relayConn: relayConn, lastActivity: time.Now()}
+	s.attach(conn)
+	m.lock.Lock()
+	if existing, ok := m.sessions[id]; ok {
+		// Another datachannel for the same new client ID raced us and
+		// won while we were dialing; use its session and tear down the
+		// one we just built instead of leaking it.
+		m.lock.Unlock()
+		s.Close()
+		existing.attach(conn)
+		existing.touch()
+		return existing, nil
+	}
+	m.sessions[id] = s
+	m.lock.Unlock()
+	go s.relayPump()
+	return s, nil
+}
+
+// serveDataChannel attaches conn, the webRTCConn already sniffed for its
+// Turbo Tunnel header, to the logical session for id as the destination
+// for relay->client bytes, and copies client->relay bytes directly onto
+// relayConn. It returns once conn's leg of the session ends; the
+// sessionState and its relayConn survive so the client can resume the
+// same relay-side session through another datachannel later, including
+// one that lands on a different proxy process.
+func (m *turboTunnelManager) serveDataChannel(id clientID, clientIP string, conn io.ReadWriteCloser) error {
+	s, err := m.sessionFor(id, clientIP, conn)
+	if err != nil {
+		return err
+	}
+	defer s.detach(conn)
+	_, err = io.Copy(s.relayConn, conn)
+	s.touch()
+	return err
+}
+
+// peekTurboTunnelHeader inspects b, the bytes read from the start of a
+// datachannel, for the Turbo Tunnel magic prefix. If present, it returns
+// the client ID encoded immediately after the magic, plus any payload
+// bytes that followed the header in the same read. If absent, ok is
+// false and leftover is simply b, unconsumed.
+func peekTurboTunnelHeader(b []byte) (id clientID, leftover []byte, ok bool) {
+	if len(b) < turboTunnelHeaderLength || !bytes.Equal(b[:len(turboTunnelMagic)], turboTunnelMagic[:]) {
+		return clientID{}, b, false
+	}
+	copy(id[:], b[len(turboTunnelMagic):turboTunnelHeaderLength])
+	return id, b[turboTunnelHeaderLength:], true
+}
+
+// prefixedReader replays prefix before falling through to r. It lets
+// datachannelHandler peek at a connection's first bytes to detect a Turbo
+// Tunnel header and then hand the (possibly trimmed) stream on to the
+// relay copier as if nothing had been read yet.
+type prefixedReader struct {
+	prefix []byte
+	r      io.Reader
+}
+
+func (p *prefixedReader) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
@@ -0,0 +1,40 @@
+package snowflake_proxy
+
+import (
+	"net"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newWebRTCAPI builds a *webrtc.API configured from sf's ICE-related
+// fields (ephemeral port range, interface/IP allowlist), with mDNS
+// candidates always disabled. Operators
+// behind restrictive firewalls or on multi-homed hosts use these to pin
+// which local address snowflake traffic gathers ICE candidates from.
+func (sf *SnowflakeProxy) newWebRTCAPI() (*webrtc.API, error) {
+	var settingEngine webrtc.SettingEngine
+
+	if sf.EphemeralMinPort != 0 && sf.EphemeralMaxPort != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(sf.EphemeralMinPort, sf.EphemeralMaxPort); err != nil {
+			return nil, err
+		}
+	}
+
+	if sf.ICEInterface != "" {
+		if ip := net.ParseIP(sf.ICEInterface); ip != nil {
+			settingEngine.SetIPFilter(func(candidateIP net.IP) bool {
+				return candidateIP.Equal(ip)
+			})
+		} else {
+			settingEngine.SetInterfaceFilter(func(ifName string) bool {
+				return ifName == sf.ICEInterface
+			})
+		}
+	}
+
+	// mDNS candidates leak the proxy's hostname and aren't resolvable by
+	// the broker/client anyway; disable them unconditionally.
+	settingEngine.SetICEMulticastDNSMode(webrtc.ICEMulticastDNSModeDisabled)
+
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)), nil
+}
@@ -9,11 +9,13 @@ import (
 	"net"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/ice/v4"
 	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
+	"golang.org/x/time/rate"
 )
 
 const maxBufferedAmount uint64 = 512 * 1024 // 512 KB
@@ -36,15 +38,31 @@ type webRTCConn struct {
 	inactivityTimeout time.Duration
 	activity          chan struct{}
 	sendMoreCh        chan struct{}
+	closing           chan struct{} // closed once, by Close, to unblock a Write parked on sendMoreCh
 	cancelTimeoutLoop context.CancelFunc
 
 	bytesLogger bytesLogger
+
+	// sessionOutbound and sessionInbound total this one connection's
+	// bytes, independent of bytesLogger's proxy-wide rolling totals, so
+	// the caller can report a per-session EventOnProxyConnectionOver when
+	// the connection ends.
+	sessionOutbound int64
+	sessionInbound  int64
+
+	// clientLimiter throttles this single connection's outbound
+	// (proxy-to-client) rate. globalLimiter, shared across every
+	// webRTCConn belonging to the same SnowflakeProxy, throttles the
+	// aggregate outbound rate. Either may be nil, meaning unlimited.
+	clientLimiter *rate.Limiter
+	globalLimiter *rate.Limiter
 }
 
 func newWebRTCConn(pc *webrtc.PeerConnection, dc *webrtc.DataChannel, pr *io.PipeReader, bytesLogger bytesLogger) *webRTCConn {
 	conn := &webRTCConn{pc: pc, dc: dc, pr: pr, bytesLogger: bytesLogger}
 	conn.activity = make(chan struct{}, 100)
 	conn.sendMoreCh = make(chan struct{}, 1)
+	conn.closing = make(chan struct{})
 	conn.inactivityTimeout = 30 * time.Second
 	ctx, cancel := context.WithCancel(context.Background())
 	conn.cancelTimeoutLoop = cancel
@@ -73,29 +91,88 @@ func (c *webRTCConn) timeoutLoop(ctx context.Context) {
 }
 
 func (c *webRTCConn) Read(b []byte) (int, error) {
-	return c.pr.Read(b)
+	n, err := c.pr.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.sessionOutbound, int64(n))
+		c.bytesLogger.AddOutbound(int64(n))
+	}
+	return n, err
+}
+
+// bytesTransferred returns the total bytes relayed on this connection so
+// far, in the same (inbound, outbound) sense as EventOnProxyConnectionOver.
+func (c *webRTCConn) bytesTransferred() (inbound, outbound int64) {
+	return atomic.LoadInt64(&c.sessionInbound), atomic.LoadInt64(&c.sessionOutbound)
 }
 
 func (c *webRTCConn) Write(b []byte) (int, error) {
+	if err := c.throttle(len(b)); err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&c.sessionInbound, int64(len(b)))
 	c.bytesLogger.AddInbound(int64(len(b)))
 	select {
 	case c.activity <- struct{}{}:
 	default:
 	}
 	c.lock.Lock()
-	defer c.lock.Unlock()
-	if c.dc != nil {
-		_ = c.dc.Send(b)
-		if c.dc.BufferedAmount() >= maxBufferedAmount {
-			<-c.sendMoreCh
+	dc := c.dc
+	if dc != nil {
+		_ = dc.Send(b)
+	}
+	full := dc != nil && dc.BufferedAmount() >= maxBufferedAmount
+	c.lock.Unlock()
+	// Wait outside the lock: holding it here would deadlock against
+	// OnClose, which also takes c.lock to tear the DataChannel down and
+	// would then never send on sendMoreCh.
+	if full {
+		select {
+		case <-c.sendMoreCh:
+		case <-c.closing:
 		}
 	}
 	return len(b), nil
 }
 
+// throttle blocks until n bytes' worth of tokens are available from both
+// the per-connection and the (shared) global limiter, whichever are set.
+// Writes larger than a limiter's burst size are drained in burst-sized
+// chunks so WaitN never rejects them outright.
+func (c *webRTCConn) throttle(n int) error {
+	ctx := context.Background()
+	for _, l := range []*rate.Limiter{c.clientLimiter, c.globalLimiter} {
+		if l == nil {
+			continue
+		}
+		if err := waitNChunked(ctx, l, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func waitNChunked(ctx context.Context, l *rate.Limiter, n int) error {
+	burst := l.Burst()
+	if burst <= 0 {
+		burst = n
+	}
+	for n > 0 {
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
 func (c *webRTCConn) Close() (err error) {
 	c.once.Do(func() {
 		c.cancelTimeoutLoop()
+		close(c.closing)
 		err = errors.Join(c.pr.Close(), c.pc.Close())
 	})
 	return